@@ -0,0 +1,366 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Adapter translates between the OpenAI-compatible wire format this proxy
+// exposes and whatever schema a given upstream speaks, so a single
+// `/v1/chat/completions` caller can be transparently routed to Anthropic or
+// Gemini as a fallback.
+type Adapter interface {
+	// TransformRequest builds the outbound request for one attempt.
+	TransformRequest(payload map[string]interface{}, model string) (requestURL string, body []byte, headers http.Header, err error)
+	// TransformResponse converts a full, non-streaming upstream response body
+	// into an OpenAI-style chat.completion JSON object.
+	TransformResponse(body []byte) ([]byte, error)
+	// TransformResponseChunk converts one upstream SSE data chunk into an
+	// OpenAI-style chat.completion.chunk JSON object. It returns ok=false for
+	// chunks that carry no client-visible delta (e.g. Anthropic's
+	// message_start) so the caller can skip emitting them.
+	TransformResponseChunk(chunk []byte) (out []byte, ok bool, err error)
+}
+
+// adapterFor returns the Adapter for an upstream's configured protocol,
+// defaulting to pass-through OpenAI semantics.
+func adapterFor(u *upstream) Adapter {
+	switch strings.ToLower(u.Protocol) {
+	case "anthropic":
+		return &anthropicAdapter{upstream: u}
+	case "gemini":
+		return &geminiAdapter{upstream: u}
+	default:
+		return &openaiAdapter{upstream: u}
+	}
+}
+
+// openaiAdapter is a pass-through: the wire format already matches.
+type openaiAdapter struct {
+	upstream *upstream
+}
+
+func (a *openaiAdapter) TransformRequest(payload map[string]interface{}, model string) (string, []byte, http.Header, error) {
+	payload["model"] = model
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	u := *a.upstream.url
+	u.Path = singleJoiningSlash(u.Path, "/v1/chat/completions")
+	headers := http.Header{}
+	if a.upstream.APIKey != "" {
+		headers.Set("Authorization", "Bearer "+a.upstream.APIKey)
+	}
+	return u.String(), body, headers, nil
+}
+
+func (a *openaiAdapter) TransformResponse(body []byte) ([]byte, error) {
+	return body, nil
+}
+
+func (a *openaiAdapter) TransformResponseChunk(chunk []byte) ([]byte, bool, error) {
+	return chunk, true, nil
+}
+
+// anthropicMessage/anthropicRequest model the subset of the Messages API we
+// need to round-trip an OpenAI chat.completion request.
+type anthropicRequest struct {
+	Model     string             `json:"model"`
+	Messages  []anthropicMessage `json:"messages"`
+	System    string             `json:"system,omitempty"`
+	MaxTokens int                `json:"max_tokens"`
+	Stream    bool               `json:"stream,omitempty"`
+}
+
+type anthropicMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type anthropicResponse struct {
+	Content []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	} `json:"content"`
+	StopReason string `json:"stop_reason"`
+	Usage      struct {
+		InputTokens  int `json:"input_tokens"`
+		OutputTokens int `json:"output_tokens"`
+	} `json:"usage"`
+}
+
+type anthropicStreamEvent struct {
+	Type  string `json:"type"`
+	Delta struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	} `json:"delta"`
+}
+
+type anthropicAdapter struct {
+	upstream *upstream
+}
+
+const defaultAnthropicMaxTokens = 4096
+
+func (a *anthropicAdapter) TransformRequest(payload map[string]interface{}, model string) (string, []byte, http.Header, error) {
+	var system string
+	var messages []anthropicMessage
+	if raw, ok := payload["messages"].([]interface{}); ok {
+		for _, m := range raw {
+			entry, ok := m.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			role, _ := entry["role"].(string)
+			content, _ := entry["content"].(string)
+			if role == "system" {
+				system = content
+				continue
+			}
+			if role == "assistant" {
+				role = "assistant"
+			} else {
+				role = "user"
+			}
+			messages = append(messages, anthropicMessage{Role: role, Content: content})
+		}
+	}
+
+	maxTokens := defaultAnthropicMaxTokens
+	if v, ok := payload["max_tokens"].(float64); ok && v > 0 {
+		maxTokens = int(v)
+	}
+
+	req := anthropicRequest{
+		Model:     model,
+		Messages:  messages,
+		System:    system,
+		MaxTokens: maxTokens,
+		Stream:    isStreamRequest(payload),
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	u := *a.upstream.url
+	u.Path = singleJoiningSlash(u.Path, "/v1/messages")
+	headers := http.Header{}
+	headers.Set("x-api-key", a.upstream.APIKey)
+	headers.Set("anthropic-version", "2023-06-01")
+	return u.String(), body, headers, nil
+}
+
+func (a *anthropicAdapter) TransformResponse(body []byte) ([]byte, error) {
+	var resp anthropicResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, err
+	}
+	var text strings.Builder
+	for _, block := range resp.Content {
+		if block.Type == "text" {
+			text.WriteString(block.Text)
+		}
+	}
+	out := openAIChatCompletion(text.String(), anthropicStopReason(resp.StopReason), resp.Usage.InputTokens, resp.Usage.OutputTokens)
+	return json.Marshal(out)
+}
+
+func (a *anthropicAdapter) TransformResponseChunk(chunk []byte) ([]byte, bool, error) {
+	var event anthropicStreamEvent
+	if err := json.Unmarshal(chunk, &event); err != nil {
+		return nil, false, err
+	}
+	if event.Type != "content_block_delta" || event.Delta.Text == "" {
+		return nil, false, nil
+	}
+	out := openAIChatCompletionChunk(event.Delta.Text, "")
+	encoded, err := json.Marshal(out)
+	return encoded, true, err
+}
+
+func anthropicStopReason(reason string) string {
+	if reason == "end_turn" || reason == "stop_sequence" {
+		return "stop"
+	}
+	if reason == "max_tokens" {
+		return "length"
+	}
+	return reason
+}
+
+// geminiAdapter targets Google's generateContent / streamGenerateContent API.
+type geminiAdapter struct {
+	upstream *upstream
+}
+
+type geminiContent struct {
+	Role  string       `json:"role"`
+	Parts []geminiPart `json:"parts"`
+}
+
+type geminiPart struct {
+	Text string `json:"text"`
+}
+
+type geminiRequest struct {
+	Contents          []geminiContent          `json:"contents"`
+	SystemInstruction *geminiSystemInstruction `json:"systemInstruction,omitempty"`
+}
+
+type geminiSystemInstruction struct {
+	Parts []geminiPart `json:"parts"`
+}
+
+type geminiResponse struct {
+	Candidates []struct {
+		Content      geminiContent `json:"content"`
+		FinishReason string        `json:"finishReason"`
+	} `json:"candidates"`
+	UsageMetadata struct {
+		PromptTokenCount     int `json:"promptTokenCount"`
+		CandidatesTokenCount int `json:"candidatesTokenCount"`
+	} `json:"usageMetadata"`
+}
+
+func (a *geminiAdapter) TransformRequest(payload map[string]interface{}, model string) (string, []byte, http.Header, error) {
+	var system string
+	var contents []geminiContent
+	if raw, ok := payload["messages"].([]interface{}); ok {
+		for _, m := range raw {
+			entry, ok := m.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			role, _ := entry["role"].(string)
+			content, _ := entry["content"].(string)
+			if role == "system" {
+				system = content
+				continue
+			}
+			if role == "assistant" {
+				role = "model"
+			} else {
+				role = "user"
+			}
+			contents = append(contents, geminiContent{Role: role, Parts: []geminiPart{{Text: content}}})
+		}
+	}
+
+	req := geminiRequest{Contents: contents}
+	if system != "" {
+		req.SystemInstruction = &geminiSystemInstruction{Parts: []geminiPart{{Text: system}}}
+	}
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	method := "generateContent"
+	if isStreamRequest(payload) {
+		method = "streamGenerateContent"
+	}
+	u := *a.upstream.url
+	u.Path = singleJoiningSlash(u.Path, fmt.Sprintf("/v1beta/models/%s:%s", model, method))
+	q := u.Query()
+	q.Set("key", a.upstream.APIKey)
+	if method == "streamGenerateContent" {
+		q.Set("alt", "sse")
+	}
+	u.RawQuery = q.Encode()
+
+	headers := http.Header{}
+	headers.Set("Content-Type", "application/json")
+	return u.String(), body, headers, nil
+}
+
+func (a *geminiAdapter) TransformResponse(body []byte) ([]byte, error) {
+	var resp geminiResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, err
+	}
+	var text strings.Builder
+	finish := "stop"
+	if len(resp.Candidates) > 0 {
+		for _, part := range resp.Candidates[0].Content.Parts {
+			text.WriteString(part.Text)
+		}
+		finish = geminiFinishReason(resp.Candidates[0].FinishReason)
+	}
+	out := openAIChatCompletion(text.String(), finish, resp.UsageMetadata.PromptTokenCount, resp.UsageMetadata.CandidatesTokenCount)
+	return json.Marshal(out)
+}
+
+func (a *geminiAdapter) TransformResponseChunk(chunk []byte) ([]byte, bool, error) {
+	var resp geminiResponse
+	if err := json.Unmarshal(chunk, &resp); err != nil {
+		return nil, false, err
+	}
+	if len(resp.Candidates) == 0 || len(resp.Candidates[0].Content.Parts) == 0 {
+		return nil, false, nil
+	}
+	text := resp.Candidates[0].Content.Parts[0].Text
+	if text == "" {
+		return nil, false, nil
+	}
+	out := openAIChatCompletionChunk(text, "")
+	encoded, err := json.Marshal(out)
+	return encoded, true, err
+}
+
+func geminiFinishReason(reason string) string {
+	switch reason {
+	case "MAX_TOKENS":
+		return "length"
+	case "STOP", "":
+		return "stop"
+	default:
+		return strings.ToLower(reason)
+	}
+}
+
+// openAIChatCompletion builds a minimal, non-streaming OpenAI-shaped
+// response so callers see a consistent wire format regardless of upstream.
+func openAIChatCompletion(text, finishReason string, promptTokens, completionTokens int) map[string]interface{} {
+	return map[string]interface{}{
+		"object": "chat.completion",
+		"choices": []map[string]interface{}{
+			{
+				"index": 0,
+				"message": map[string]interface{}{
+					"role":    "assistant",
+					"content": text,
+				},
+				"finish_reason": finishReason,
+			},
+		},
+		"usage": map[string]interface{}{
+			"prompt_tokens":     promptTokens,
+			"completion_tokens": completionTokens,
+			"total_tokens":      promptTokens + completionTokens,
+		},
+	}
+}
+
+// openAIChatCompletionChunk builds a minimal OpenAI-shaped streaming chunk.
+func openAIChatCompletionChunk(text, finishReason string) map[string]interface{} {
+	delta := map[string]interface{}{}
+	if text != "" {
+		delta["content"] = text
+	}
+	return map[string]interface{}{
+		"object": "chat.completion.chunk",
+		"choices": []map[string]interface{}{
+			{
+				"index":         0,
+				"delta":         delta,
+				"finish_reason": finishReason,
+			},
+		},
+	}
+}
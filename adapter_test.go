@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+	"testing"
+)
+
+func testUpstream(t *testing.T, apiKey string) *upstream {
+	t.Helper()
+	parsed, err := url.Parse("https://api.example.com")
+	if err != nil {
+		t.Fatalf("parse test upstream url: %v", err)
+	}
+	return &upstream{Name: "test", APIKey: apiKey, url: parsed}
+}
+
+func chatPayload(messages ...map[string]interface{}) map[string]interface{} {
+	msgs := make([]interface{}, len(messages))
+	for i, m := range messages {
+		msgs[i] = m
+	}
+	return map[string]interface{}{"messages": msgs}
+}
+
+func msg(role, content string) map[string]interface{} {
+	return map[string]interface{}{"role": role, "content": content}
+}
+
+func TestAnthropicAdapterTransformRequestExtractsSystem(t *testing.T) {
+	a := &anthropicAdapter{upstream: testUpstream(t, "sk-ant-test")}
+	payload := chatPayload(
+		msg("system", "be concise"),
+		msg("user", "hi"),
+		msg("assistant", "hello"),
+	)
+
+	_, body, headers, err := a.TransformRequest(payload, "claude-3-opus")
+	if err != nil {
+		t.Fatalf("TransformRequest: %v", err)
+	}
+
+	var req anthropicRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		t.Fatalf("unmarshal request body: %v", err)
+	}
+	if req.System != "be concise" {
+		t.Errorf("System = %q, want %q", req.System, "be concise")
+	}
+	if len(req.Messages) != 2 {
+		t.Fatalf("len(Messages) = %d, want 2 (system message must not appear in messages)", len(req.Messages))
+	}
+	if req.Messages[0].Role != "user" || req.Messages[1].Role != "assistant" {
+		t.Errorf("Messages roles = %+v, want [user assistant]", req.Messages)
+	}
+	if got := headers.Get("x-api-key"); got != "sk-ant-test" {
+		t.Errorf("x-api-key header = %q, want %q", got, "sk-ant-test")
+	}
+}
+
+func TestAnthropicAdapterTransformResponse(t *testing.T) {
+	body := []byte(`{
+		"content": [{"type": "text", "text": "hi there"}],
+		"stop_reason": "end_turn",
+		"usage": {"input_tokens": 3, "output_tokens": 2}
+	}`)
+	a := &anthropicAdapter{upstream: testUpstream(t, "key")}
+
+	out, err := a.TransformResponse(body)
+	if err != nil {
+		t.Fatalf("TransformResponse: %v", err)
+	}
+
+	var got map[string]interface{}
+	if err := json.Unmarshal(out, &got); err != nil {
+		t.Fatalf("unmarshal output: %v", err)
+	}
+	choices, _ := got["choices"].([]interface{})
+	if len(choices) != 1 {
+		t.Fatalf("len(choices) = %d, want 1", len(choices))
+	}
+	choice := choices[0].(map[string]interface{})
+	message := choice["message"].(map[string]interface{})
+	if message["content"] != "hi there" {
+		t.Errorf("content = %v, want %q", message["content"], "hi there")
+	}
+	if choice["finish_reason"] != "stop" {
+		t.Errorf("finish_reason = %v, want %q (end_turn should map to stop)", choice["finish_reason"], "stop")
+	}
+}
+
+func TestGeminiAdapterTransformRequestUsesSystemInstruction(t *testing.T) {
+	a := &geminiAdapter{upstream: testUpstream(t, "gemini-key")}
+	payload := chatPayload(
+		msg("system", "answer briefly"),
+		msg("user", "hi"),
+		msg("assistant", "hello"),
+	)
+
+	_, body, _, err := a.TransformRequest(payload, "gemini-1.5-pro")
+	if err != nil {
+		t.Fatalf("TransformRequest: %v", err)
+	}
+
+	var req geminiRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		t.Fatalf("unmarshal request body: %v", err)
+	}
+	if req.SystemInstruction == nil || len(req.SystemInstruction.Parts) != 1 || req.SystemInstruction.Parts[0].Text != "answer briefly" {
+		t.Fatalf("SystemInstruction = %+v, want a single part %q", req.SystemInstruction, "answer briefly")
+	}
+	for _, c := range req.Contents {
+		if c.Role != "user" && c.Role != "model" {
+			t.Errorf("unexpected content role %q in contents", c.Role)
+		}
+	}
+	if len(req.Contents) != 2 {
+		t.Fatalf("len(Contents) = %d, want 2 (system message must not appear in contents)", len(req.Contents))
+	}
+	if req.Contents[1].Role != "model" {
+		t.Errorf("assistant message role = %q, want %q", req.Contents[1].Role, "model")
+	}
+}
+
+func TestGeminiAdapterTransformResponse(t *testing.T) {
+	body := []byte(`{
+		"candidates": [{
+			"content": {"role": "model", "parts": [{"text": "hi there"}]},
+			"finishReason": "STOP"
+		}],
+		"usageMetadata": {"promptTokenCount": 4, "candidatesTokenCount": 2}
+	}`)
+	a := &geminiAdapter{upstream: testUpstream(t, "gemini-key")}
+
+	out, err := a.TransformResponse(body)
+	if err != nil {
+		t.Fatalf("TransformResponse: %v", err)
+	}
+
+	var got map[string]interface{}
+	if err := json.Unmarshal(out, &got); err != nil {
+		t.Fatalf("unmarshal output: %v", err)
+	}
+	usage := got["usage"].(map[string]interface{})
+	if usage["prompt_tokens"] != float64(4) || usage["completion_tokens"] != float64(2) {
+		t.Errorf("usage = %+v, want prompt=4 completion=2", usage)
+	}
+}
+
+func TestOpenAIAdapterTransformRequestPassthrough(t *testing.T) {
+	a := &openaiAdapter{upstream: testUpstream(t, "sk-test")}
+	payload := chatPayload(msg("user", "hi"))
+
+	_, body, headers, err := a.TransformRequest(payload, "gpt-4o")
+	if err != nil {
+		t.Fatalf("TransformRequest: %v", err)
+	}
+
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(body, &decoded); err != nil {
+		t.Fatalf("unmarshal request body: %v", err)
+	}
+	if decoded["model"] != "gpt-4o" {
+		t.Errorf("model = %v, want %q", decoded["model"], "gpt-4o")
+	}
+	if got := headers.Get("Authorization"); got != "Bearer sk-test" {
+		t.Errorf("Authorization header = %q, want %q", got, "Bearer sk-test")
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// identityKey is the gin context key under which the authenticated identity
+// (if any) is stored, for later per-token upstream key rewriting.
+const identityKey = "llm-router.identity"
+
+// upstreamKeyOverride is the gin context key holding the upstream API key to
+// substitute for the authenticated client's own token, when configured.
+const upstreamKeyOverride = "llm-router.upstream-key-override"
+
+// Auth validates an inbound request before it reaches the proxy handler.
+type Auth interface {
+	Validate(c *gin.Context) bool
+}
+
+// noneAuth accepts every request; it's the default when AUTH is unset.
+type noneAuth struct{}
+
+func (noneAuth) Validate(c *gin.Context) bool { return true }
+
+// staticAuth validates a bearer token against a fixed set of accepted
+// tokens, optionally rewriting the client token to an upstream API key.
+type staticAuth struct {
+	tokens   map[string]struct{}
+	rewrites map[string]string
+}
+
+func (a *staticAuth) Validate(c *gin.Context) bool {
+	token := bearerToken(c.GetHeader("Authorization"))
+	if token == "" {
+		return false
+	}
+	for candidate := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(candidate), []byte(token)) == 1 {
+			c.Set(identityKey, token)
+			if upstreamKey, ok := a.rewrites[token]; ok {
+				c.Set(upstreamKeyOverride, upstreamKey)
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// basicFileAuth validates HTTP Basic credentials against a
+// "username:bcrypt-hash" file, htpasswd-style.
+type basicFileAuth struct {
+	users map[string][]byte // username -> bcrypt hash
+}
+
+func (a *basicFileAuth) Validate(c *gin.Context) bool {
+	username, password, ok := c.Request.BasicAuth()
+	if !ok {
+		return false
+	}
+	hash, ok := a.users[username]
+	if !ok {
+		return false
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return false
+	}
+	c.Set(identityKey, username)
+	return true
+}
+
+// certAuth requires the connection to present a verified TLS client certificate.
+// It only works when the server is actually serving TLS with client cert
+// verification enabled; see certAuthTLSConfig and its use in main().
+type certAuth struct{}
+
+func (certAuth) Validate(c *gin.Context) bool {
+	if c.Request.TLS == nil || len(c.Request.TLS.VerifiedChains) == 0 {
+		return false
+	}
+	c.Set(identityKey, c.Request.TLS.VerifiedChains[0][0].Subject.CommonName)
+	return true
+}
+
+// Environment variables that configure the TLS listener required by
+// AUTH=cert://. The proxy otherwise never terminates TLS itself.
+const (
+	envTLSCertFile     = "TLS_CERT_FILE"
+	envTLSKeyFile      = "TLS_KEY_FILE"
+	envTLSClientCAFile = "TLS_CLIENT_CA_FILE"
+)
+
+// certAuthTLSConfig builds the server TLS config AUTH=cert:// requires:
+// client certificates must be presented and verified against the configured
+// CA pool before a request ever reaches certAuth.Validate.
+func certAuthTLSConfig() (*tls.Config, error) {
+	caFile := envOrDefault(envTLSClientCAFile, "")
+	if caFile == "" {
+		return nil, fmt.Errorf("%s must be set", envTLSClientCAFile)
+	}
+	caPEM, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", envTLSClientCAFile, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+	return &tls.Config{
+		ClientCAs:  pool,
+		ClientAuth: tls.RequireAndVerifyClientCert,
+	}, nil
+}
+
+// NewAuth builds an Auth from a URL-like spec: "static://token1,token2",
+// "basicfile:///etc/llm-router/users", "cert://", or "none://".
+func NewAuth(spec string) Auth {
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return noneAuth{}
+	}
+
+	scheme, rest, ok := strings.Cut(spec, "://")
+	if !ok {
+		log.Printf("[config] invalid AUTH spec %q, disabling auth", spec)
+		return noneAuth{}
+	}
+
+	switch scheme {
+	case "none":
+		return noneAuth{}
+	case "static":
+		return newStaticAuth(rest)
+	case "basicfile":
+		return newBasicFileAuth(rest)
+	case "cert":
+		return certAuth{}
+	default:
+		log.Printf("[config] unknown AUTH scheme %q, disabling auth", scheme)
+		return noneAuth{}
+	}
+}
+
+// newStaticAuth parses a comma-separated token list, optionally with a
+// "token=upstreamKey" rewrite ("tokA,tokB=sk-upstream,tokC").
+func newStaticAuth(rest string) *staticAuth {
+	tokens := make(map[string]struct{})
+	rewrites := make(map[string]string)
+	for _, part := range strings.Split(rest, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if token, upstreamKey, ok := strings.Cut(part, "="); ok {
+			tokens[token] = struct{}{}
+			rewrites[token] = upstreamKey
+			continue
+		}
+		tokens[part] = struct{}{}
+	}
+	return &staticAuth{tokens: tokens, rewrites: rewrites}
+}
+
+func newBasicFileAuth(path string) *basicFileAuth {
+	users := make(map[string][]byte)
+	f, err := os.Open(path)
+	if err != nil {
+		log.Printf("[config] failed to open basicfile %q: %v, all requests will be rejected", path, err)
+		return &basicFileAuth{users: users}
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		username, hash, ok := strings.Cut(line, ":")
+		if !ok {
+			log.Printf("[config] skipping malformed basicfile line: %q", line)
+			continue
+		}
+		users[username] = []byte(hash)
+	}
+	if err := scanner.Err(); err != nil {
+		log.Printf("[config] error reading basicfile %q: %v", path, err)
+	}
+	return &basicFileAuth{users: users}
+}
+
+// isNoneAuth reports whether a is the default no-op Auth, i.e. AUTH is unset,
+// none://, or a spec NewAuth could not parse or recognise.
+func isNoneAuth(a Auth) bool {
+	_, ok := a.(noneAuth)
+	return ok
+}
+
+func bearerToken(header string) string {
+	const prefix = "Bearer "
+	if !strings.HasPrefix(header, prefix) {
+		return ""
+	}
+	return strings.TrimSpace(header[len(prefix):])
+}
+
+// authMiddleware rejects unauthenticated requests with 401 before they reach
+// the proxy handler.
+func authMiddleware(a Auth) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !a.Validate(c) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+			return
+		}
+		c.Next()
+	}
+}
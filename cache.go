@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	defaultCacheTTL         = 5 * time.Minute
+	defaultCacheMaxBodySize = 1 << 20 // 1 MiB
+	defaultCacheMaxEntries  = 1000
+	defaultCacheMaxBytes    = 256 << 20 // 256 MiB
+
+	cacheHeaderName    = "X-LLM-Router-Cache"
+	cacheHeaderNoStore = "no-store"
+)
+
+// Cache stores non-streaming responses keyed by a normalized request hash so
+// repeated, deterministic completions can skip the upstream round trip.
+type Cache interface {
+	Get(ctx context.Context, key string) (*cachedResponse, bool)
+	Set(ctx context.Context, key string, resp *cachedResponse, ttl time.Duration)
+}
+
+// cacheBlocklistDefault lists payload keys that never participate in the
+// cache key, beyond the always-excluded "stream" and "user".
+var cacheBlocklistDefault = []string{"request_id"}
+
+type responseCache struct {
+	backend               Cache
+	ttl                   time.Duration
+	maxBodySize           int
+	blocklist             map[string]struct{}
+	allowNondeterministic bool
+}
+
+// newResponseCache builds the cache described by CACHE_BACKEND, CACHE_TTL,
+// CACHE_MAX_BODY_SIZE, CACHE_BLOCKLIST, and CACHE_NONDETERMINISTIC.
+func newResponseCache() *responseCache {
+	blocklist := make(map[string]struct{})
+	for _, key := range cacheBlocklistDefault {
+		blocklist[key] = struct{}{}
+	}
+	for _, key := range parseModelList(envOrDefault("CACHE_BLOCKLIST", "")) {
+		blocklist[key] = struct{}{}
+	}
+
+	var backend Cache
+	switch strings.ToLower(envOrDefault("CACHE_BACKEND", "memory")) {
+	case "redis":
+		backend = newRedisCache(envOrDefault("REDIS_ADDR", "localhost:6379"))
+	case "memory", "":
+		backend = newMemoryCache(defaultCacheMaxEntries, defaultCacheMaxBytes)
+	default:
+		log.Printf("[config] unknown CACHE_BACKEND=%q, using memory", envOrDefault("CACHE_BACKEND", ""))
+		backend = newMemoryCache(defaultCacheMaxEntries, defaultCacheMaxBytes)
+	}
+
+	return &responseCache{
+		backend:               backend,
+		ttl:                   parseDurationEnv("CACHE_TTL", defaultCacheTTL),
+		maxBodySize:           parseIntEnv("CACHE_MAX_BODY_SIZE", defaultCacheMaxBodySize),
+		blocklist:             blocklist,
+		allowNondeterministic: strings.EqualFold(envOrDefault("CACHE_NONDETERMINISTIC", "false"), "true"),
+	}
+}
+
+// eligible reports whether payload/headers allow this request to use the
+// cache at all (opt-out header, non-deterministic sampling settings).
+func (rc *responseCache) eligible(c *gin.Context, payload map[string]interface{}) bool {
+	if strings.EqualFold(c.GetHeader(cacheHeaderName), cacheHeaderNoStore) {
+		return false
+	}
+	if !rc.allowNondeterministic {
+		if temp, ok := payload["temperature"].(float64); ok && temp > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (rc *responseCache) get(ctx context.Context, key string) (*cachedResponse, bool) {
+	return rc.backend.Get(ctx, key)
+}
+
+func (rc *responseCache) store(ctx context.Context, key string, resp *cachedResponse) {
+	if len(resp.body) > rc.maxBodySize {
+		return
+	}
+	rc.backend.Set(ctx, key, resp, rc.ttl)
+}
+
+// cacheKey hashes the canonicalized payload (sorted keys, blocklist and
+// "stream"/"user" omitted) plus the effective model. When AUTH is configured,
+// it also folds in the authenticated identity, so two differently
+// authenticated clients - who may be rewritten to different upstream
+// accounts/entitlements - never share a cached completion for the same
+// prompt.
+func (rc *responseCache) cacheKey(c *gin.Context, payload map[string]interface{}, model string) string {
+	canonical := make(map[string]interface{}, len(payload))
+	for k, v := range payload {
+		if k == "stream" || k == "user" {
+			continue
+		}
+		if _, blocked := rc.blocklist[k]; blocked {
+			continue
+		}
+		canonical[k] = v
+	}
+	canonical["model"] = model
+
+	keys := make([]string, 0, len(canonical))
+	for k := range canonical {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	if identity, ok := c.Get(identityKey); ok {
+		b.WriteString("identity:")
+		b.WriteString(identity.(string))
+		b.WriteByte(';')
+	}
+	for _, k := range keys {
+		b.WriteString(k)
+		b.WriteByte(':')
+		encoded, _ := json.Marshal(canonical[k])
+		b.Write(encoded)
+		b.WriteByte(';')
+	}
+
+	sum := sha256.Sum256([]byte(b.String()))
+	return hex.EncodeToString(sum[:])
+}
+
+// memoryCache is an in-process LRU bounded by entry count and total bytes.
+type memoryCache struct {
+	mu         sync.Mutex
+	order      []string // front = most recently used
+	entries    map[string]*memoryCacheEntry
+	maxEntries int
+	maxBytes   int
+	usedBytes  int
+}
+
+type memoryCacheEntry struct {
+	resp      *cachedResponse
+	expiresAt time.Time
+	size      int
+}
+
+func newMemoryCache(maxEntries, maxBytes int) *memoryCache {
+	return &memoryCache{
+		entries:    make(map[string]*memoryCacheEntry),
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+	}
+}
+
+func (m *memoryCache) Get(_ context.Context, key string) (*cachedResponse, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry, ok := m.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(entry.expiresAt) {
+		m.removeLocked(key)
+		return nil, false
+	}
+	m.touchLocked(key)
+	return entry.resp, true
+}
+
+func (m *memoryCache) Set(_ context.Context, key string, resp *cachedResponse, ttl time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, exists := m.entries[key]; exists {
+		m.removeLocked(key)
+	}
+
+	size := len(resp.body)
+	m.entries[key] = &memoryCacheEntry{resp: resp, expiresAt: time.Now().Add(ttl), size: size}
+	m.order = append([]string{key}, m.order...)
+	m.usedBytes += size
+
+	for (len(m.order) > m.maxEntries || m.usedBytes > m.maxBytes) && len(m.order) > 0 {
+		oldest := m.order[len(m.order)-1]
+		m.removeLocked(oldest)
+	}
+}
+
+func (m *memoryCache) touchLocked(key string) {
+	for i, k := range m.order {
+		if k == key {
+			m.order = append(m.order[:i], m.order[i+1:]...)
+			break
+		}
+	}
+	m.order = append([]string{key}, m.order...)
+}
+
+func (m *memoryCache) removeLocked(key string) {
+	entry, ok := m.entries[key]
+	if !ok {
+		return
+	}
+	delete(m.entries, key)
+	m.usedBytes -= entry.size
+	for i, k := range m.order {
+		if k == key {
+			m.order = append(m.order[:i], m.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// redisCache stores entries in Redis, JSON-encoded, with a native TTL.
+type redisCache struct {
+	client *redis.Client
+}
+
+type redisCacheValue struct {
+	Status int                 `json:"status"`
+	Header map[string][]string `json:"header"`
+	Body   []byte              `json:"body"`
+}
+
+func newRedisCache(addr string) *redisCache {
+	return &redisCache{client: redis.NewClient(&redis.Options{Addr: addr})}
+}
+
+func (r *redisCache) Get(ctx context.Context, key string) (*cachedResponse, bool) {
+	raw, err := r.client.Get(ctx, key).Bytes()
+	if err != nil {
+		if err != redis.Nil {
+			log.Printf("[cache] redis get failed: %v", err)
+		}
+		return nil, false
+	}
+	var value redisCacheValue
+	if err := json.Unmarshal(raw, &value); err != nil {
+		log.Printf("[cache] redis decode failed: %v", err)
+		return nil, false
+	}
+	header := make(http.Header, len(value.Header))
+	for k, v := range value.Header {
+		header[k] = v
+	}
+	return &cachedResponse{status: value.Status, header: header, body: value.Body}, true
+}
+
+func (r *redisCache) Set(ctx context.Context, key string, resp *cachedResponse, ttl time.Duration) {
+	value := redisCacheValue{Status: resp.status, Header: map[string][]string(resp.header), Body: resp.body}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		log.Printf("[cache] redis encode failed: %v", err)
+		return
+	}
+	if err := r.client.Set(ctx, key, encoded, ttl).Err(); err != nil {
+		log.Printf("[cache] redis set failed: %v", err)
+	}
+}
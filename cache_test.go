@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func newResponseCacheForTest() *responseCache {
+	return &responseCache{
+		backend:   newMemoryCache(defaultCacheMaxEntries, defaultCacheMaxBytes),
+		ttl:       defaultCacheTTL,
+		blocklist: map[string]struct{}{"request_id": {}},
+	}
+}
+
+func TestCacheKeyIgnoresStreamAndUser(t *testing.T) {
+	rc := newResponseCacheForTest()
+	c := &gin.Context{}
+
+	payloadA := map[string]interface{}{"messages": []interface{}{"hi"}, "stream": true, "user": "alice"}
+	payloadB := map[string]interface{}{"messages": []interface{}{"hi"}, "stream": false, "user": "bob"}
+
+	if keyA, keyB := rc.cacheKey(c, payloadA, "gpt-4o"), rc.cacheKey(c, payloadB, "gpt-4o"); keyA != keyB {
+		t.Errorf("keys differ despite only stream/user differing: %q vs %q", keyA, keyB)
+	}
+}
+
+func TestCacheKeyIgnoresBlocklistedField(t *testing.T) {
+	rc := newResponseCacheForTest()
+	c := &gin.Context{}
+
+	base := map[string]interface{}{"messages": []interface{}{"hi"}}
+	withRequestID := map[string]interface{}{"messages": []interface{}{"hi"}, "request_id": "abc-123"}
+
+	if got, want := rc.cacheKey(c, withRequestID, "gpt-4o"), rc.cacheKey(c, base, "gpt-4o"); got != want {
+		t.Errorf("blocklisted field changed the cache key: %q vs %q", got, want)
+	}
+}
+
+func TestCacheKeyDiffersByModel(t *testing.T) {
+	rc := newResponseCacheForTest()
+	c := &gin.Context{}
+	payload := map[string]interface{}{"messages": []interface{}{"hi"}}
+
+	if rc.cacheKey(c, payload, "gpt-4o") == rc.cacheKey(c, payload, "gpt-4o-mini") {
+		t.Errorf("cache key should differ by effective model")
+	}
+}
+
+func TestCacheKeyFoldsAuthenticatedIdentity(t *testing.T) {
+	rc := newResponseCacheForTest()
+	payload := map[string]interface{}{"messages": []interface{}{"hi"}}
+
+	anon := &gin.Context{}
+	alice := &gin.Context{}
+	alice.Set(identityKey, "alice-token")
+	bob := &gin.Context{}
+	bob.Set(identityKey, "bob-token")
+
+	keyAnon := rc.cacheKey(anon, payload, "gpt-4o")
+	keyAlice := rc.cacheKey(alice, payload, "gpt-4o")
+	keyBob := rc.cacheKey(bob, payload, "gpt-4o")
+
+	if keyAlice == keyBob {
+		t.Fatalf("different authenticated identities must not share a cache key")
+	}
+	if keyAlice == keyAnon {
+		t.Fatalf("an authenticated identity must not share a cache key with an unauthenticated request")
+	}
+}
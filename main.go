@@ -7,8 +7,10 @@ import (
 	"errors"
 	"io"
 	"log"
+	"math"
 	"net/http"
 	"net/url"
+	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -30,6 +32,30 @@ type proxyConfig struct {
 	noRetryStatuses        map[int]struct{}
 	client                 *http.Client
 	baseTransport          *http.Transport
+
+	upstreams          []*upstreamState
+	selectionPolicy    SelectionPolicy
+	unhealthyThreshold int
+	circuitCooldown    time.Duration
+
+	streamPreflightBytes   int
+	streamPreflightTimeout time.Duration
+
+	limiter *rateLimiter
+	cache   *responseCache
+
+	// authEnabled is true whenever AUTH resolves to something other than
+	// the default none:// (an unrecognised AUTH spec also falls back to
+	// none://), i.e. the inbound Authorization header is a
+	// proxy-auth credential and must never be forwarded to an upstream as-is.
+	authEnabled bool
+}
+
+// attempt is one (model, upstream, adapter) tuple the retry loop will try in order.
+type attempt struct {
+	model    string
+	upstream *upstreamState
+	adapter  Adapter
 }
 
 type cachedResponse struct {
@@ -52,7 +78,11 @@ func main() {
 	router := gin.New()
 	router.Use(gin.Logger(), gin.Recovery())
 
-	router.Any("/v1/chat/completions", func(c *gin.Context) {
+	router.GET("/metrics", gin.WrapF(handleMetrics(cfg.limiter.metrics)))
+
+	auth := NewAuth(envOrDefault("AUTH", ""))
+	cfg.authEnabled = !isNoneAuth(auth)
+	router.Any("/v1/chat/completions", authMiddleware(auth), func(c *gin.Context) {
 		handleChatCompletion(c, cfg)
 	})
 	router.NoRoute(func(c *gin.Context) {
@@ -60,6 +90,22 @@ func main() {
 	})
 
 	listen := normalizeAddr(envOrDefault("PORT", defaultListenAddr))
+	if _, ok := auth.(certAuth); ok {
+		tlsConfig, err := certAuthTLSConfig()
+		if err != nil {
+			log.Fatalf("AUTH=cert:// requires a TLS listener: %v", err)
+		}
+		certFile := envOrDefault(envTLSCertFile, "")
+		keyFile := envOrDefault(envTLSKeyFile, "")
+		if certFile == "" || keyFile == "" {
+			log.Fatalf("AUTH=cert:// requires %s and %s to be set", envTLSCertFile, envTLSKeyFile)
+		}
+		srv := &http.Server{Addr: listen, Handler: router, TLSConfig: tlsConfig}
+		if err := srv.ListenAndServeTLS(certFile, keyFile); err != nil {
+			log.Fatalf("server start failed: %v", err)
+		}
+		return
+	}
 	if err := router.Run(listen); err != nil {
 		log.Fatalf("server start failed: %v", err)
 	}
@@ -73,7 +119,13 @@ func newProxyConfig(targetURL *url.URL) *proxyConfig {
 	baseTransport := cloneDefaultTransport()
 	client := &http.Client{Transport: baseTransport}
 
-	return &proxyConfig{
+	upstreams := parseUpstreams(envOrDefault("UPSTREAMS", ""), targetURL)
+	states := make([]*upstreamState, 0, len(upstreams))
+	for _, u := range upstreams {
+		states = append(states, newUpstreamState(u))
+	}
+
+	cfg := &proxyConfig{
 		targetURL:              targetURL,
 		fallbackModels:         parseModelList(envOrDefault("FALLBACK_MODELS", "")),
 		defaultTimeout:         defaultTimeoutVal,
@@ -82,7 +134,22 @@ func newProxyConfig(targetURL *url.URL) *proxyConfig {
 		noRetryStatuses:        parseStatusCodeSet(envOrDefault("NO_RETRY_STATUS_CODES", defaultNoRetryStatusCode)),
 		client:                 client,
 		baseTransport:          baseTransport,
+		upstreams:              states,
+		selectionPolicy:        newSelectionPolicy(envOrDefault("SELECTION_POLICY", "")),
+		unhealthyThreshold:     parseIntEnv("UNHEALTHY_THRESHOLD", defaultUnhealthyThreshold),
+		circuitCooldown:        parseDurationEnv("CIRCUIT_COOLDOWN", defaultCircuitCooldown),
+		streamPreflightBytes:   parseIntEnv("STREAM_PREFLIGHT_BYTES", defaultStreamPreflightBytes),
+		streamPreflightTimeout: parseDurationEnv("STREAM_PREFLIGHT_TIMEOUT", defaultStreamPreflightTimeout),
+		limiter:                newRateLimiter(envOrDefault("RATE_LIMIT", ""), envOrDefault("MODEL_CONCURRENCY", "")),
+		cache:                  newResponseCache(),
 	}
+
+	healthInterval := parseDurationEnv("HEALTH_CHECK_INTERVAL", defaultHealthCheckInterval)
+	healthTimeout := parseDurationEnv("HEALTH_CHECK_TIMEOUT", defaultHealthCheckTimeout)
+	healthPath := envOrDefault("HEALTH_CHECK_PATH", defaultHealthCheckPath)
+	startHealthChecker(cfg.upstreams, client, healthInterval, healthTimeout, healthPath)
+
+	return cfg
 }
 
 func handleChatCompletion(c *gin.Context, cfg *proxyConfig) {
@@ -99,9 +166,28 @@ func handleChatCompletion(c *gin.Context, cfg *proxyConfig) {
 		return
 	}
 
-	// Step 2: build retry model list (primary + fallbacks).
-	attemptModels := buildAttemptModels(modelName, cfg.fallbackModels)
-	if len(attemptModels) == 0 {
+	// Step 2: global/per-key rate limit check, ahead of any upstream work.
+	apiKey := bearerToken(c.GetHeader("Authorization"))
+	if ok, wait := cfg.limiter.allow(apiKey, modelName); !ok {
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "rate limit exceeded"})
+		return
+	}
+
+	// Step 3: check the response cache for non-streaming requests.
+	var cacheKey string
+	if !stream && cfg.cache.eligible(c, payload) {
+		cacheKey = cfg.cache.cacheKey(c, payload, modelName)
+		if cached, ok := cfg.cache.get(c.Request.Context(), cacheKey); ok {
+			c.Header(cacheHeaderName, "HIT")
+			writeResponse(c.Writer, cached)
+			return
+		}
+	}
+
+	// Step 4: build retry (model, upstream) pairs (primary + fallbacks).
+	attempts := buildAttempts(cfg, modelName)
+	if len(attempts) == 0 {
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "no model available"})
 		return
 	}
@@ -109,86 +195,146 @@ func handleChatCompletion(c *gin.Context, cfg *proxyConfig) {
 	var lastResp *cachedResponse
 	var lastErr error
 
-	// Step 3: try each model in order until success or a non-retry status.
-	for idx, model := range attemptModels {
-		outboundBody, err := marshalPayloadWithModel(payload, model)
-		if err != nil {
-			log.Printf("[proxy] marshal body failed: %v", err)
-			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "invalid json body"})
-			return
-		}
+	// Step 5: try each (model, upstream) pair in order until success or a non-retry status.
+	for idx, a := range attempts {
+		label := attemptLabel(a)
 
-		timeout := timeoutForAttempt(cfg, idx, model)
-		resp, err := doUpstreamRequest(c.Request, cfg, outboundBody, timeout, stream)
-		if err != nil {
-			if errors.Is(err, context.Canceled) {
-				log.Printf("[proxy] request canceled")
-				return
+		stop := func() bool {
+			timeout := timeoutForAttempt(cfg, idx, a)
+
+			acquireCtx := c.Request.Context()
+			if timeout > 0 {
+				var cancel context.CancelFunc
+				acquireCtx, cancel = context.WithTimeout(acquireCtx, timeout)
+				defer cancel()
+			}
+			release, err := cfg.limiter.acquireModel(acquireCtx, a.model)
+			if err != nil {
+				lastErr = err
+				log.Printf("[proxy] model concurrency exhausted %s: %v", label, err)
+				return false
+			}
+			defer release()
+
+			requestURL, outboundBody, adapterHeaders, err := a.adapter.TransformRequest(payload, a.model)
+			if err != nil {
+				log.Printf("[proxy] transform request failed %s: %v", label, err)
+				c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "invalid json body"})
+				return true
 			}
-			lastErr = err
-			log.Printf("[proxy] upstream error model=%s attempt=%d/%d: %v", model, idx+1, len(attemptModels), err)
-			continue
-		}
 
-		if stream {
-			if isSuccessStatus(resp.StatusCode) {
-				copyHeaders(c.Writer.Header(), resp.Header)
-				stripHopByHopHeaders(c.Writer.Header())
-				c.Writer.WriteHeader(resp.StatusCode)
-				if err := copyStream(c.Writer, resp.Body); err != nil {
+			a.upstream.acquire()
+			resp, err := doUpstreamRequest(c, cfg, a, requestURL, outboundBody, adapterHeaders, timeout, stream)
+			a.upstream.release()
+			if err != nil {
+				a.upstream.recordResult(false, cfg.unhealthyThreshold)
+				if errors.Is(err, context.Canceled) {
+					log.Printf("[proxy] request canceled")
+					return true
+				}
+				lastErr = err
+				log.Printf("[proxy] upstream error %s attempt=%d/%d: %v", label, idx+1, len(attempts), err)
+				return false
+			}
+
+			if stream {
+				if isSuccessStatus(resp.StatusCode) {
+					// Build this attempt's headers into a fresh map rather than
+					// merging them into c.Writer.Header() directly: if preflight
+					// fails we retry the next attempt, and c.Writer.Header() must
+					// not carry over headers (e.g. Content-Encoding) from an
+					// attempt whose body was never written.
+					header := cloneHeader(resp.Header)
+					stripHopByHopHeaders(header)
+					err := streamWithPreflight(c.Writer, resp, header, a.adapter, cfg.streamPreflightBytes, cfg.streamPreflightTimeout)
+					if err == nil {
+						a.upstream.recordResult(true, cfg.unhealthyThreshold)
+						return true
+					}
+					a.upstream.recordResult(false, cfg.unhealthyThreshold)
 					if errors.Is(err, context.Canceled) {
 						log.Printf("[proxy] stream canceled")
-						return
+						return true
+					}
+					if errors.Is(err, errStreamPreflightFailed) {
+						lastErr = err
+						log.Printf("[proxy] stream preflight failed %s attempt=%d/%d, retrying", label, idx+1, len(attempts))
+						return false
 					}
-					log.Printf("[proxy] stream copy failed model=%s: %v", model, err)
+					log.Printf("[proxy] stream copy failed %s: %v", label, err)
+					return true
 				}
-				return
+
+				candidate, readErr := readResponse(resp)
+				if readErr != nil {
+					lastErr = readErr
+					log.Printf("[proxy] read error response failed %s: %v", label, readErr)
+					return false
+				}
+				recordCircuitOutcome(a.upstream, candidate.status, cfg.unhealthyThreshold)
+
+				if isNoRetryStatus(candidate.status, cfg.noRetryStatuses) {
+					writeResponse(c.Writer, candidate)
+					return true
+				}
+
+				lastResp = candidate
+				log.Printf("[proxy] retrying %s status=%d attempt=%d/%d", label, candidate.status, idx+1, len(attempts))
+				return false
 			}
 
 			candidate, readErr := readResponse(resp)
 			if readErr != nil {
 				lastErr = readErr
-				log.Printf("[proxy] read error response failed model=%s: %v", model, readErr)
-				continue
+				log.Printf("[proxy] read response failed %s: %v", label, readErr)
+				return false
+			}
+			recordCircuitOutcome(a.upstream, candidate.status, cfg.unhealthyThreshold)
+
+			if isSuccessStatus(candidate.status) {
+				normalized, normErr := a.adapter.TransformResponse(candidate.body)
+				if normErr != nil {
+					lastErr = normErr
+					log.Printf("[proxy] normalize response failed %s: %v", label, normErr)
+					return false
+				}
+				candidate.body = normalized
+				if cacheKey != "" {
+					cfg.cache.store(c.Request.Context(), cacheKey, candidate)
+				}
+				writeResponse(c.Writer, candidate)
+				return true
 			}
 
 			if isNoRetryStatus(candidate.status, cfg.noRetryStatuses) {
 				writeResponse(c.Writer, candidate)
-				return
+				return true
 			}
 
 			lastResp = candidate
-			log.Printf("[proxy] retrying model=%s status=%d attempt=%d/%d", model, candidate.status, idx+1, len(attemptModels))
-			continue
-		}
-
-		candidate, readErr := readResponse(resp)
-		if readErr != nil {
-			lastErr = readErr
-			log.Printf("[proxy] read response failed model=%s: %v", model, readErr)
-			continue
-		}
-
-		if isSuccessStatus(candidate.status) {
-			writeResponse(c.Writer, candidate)
-			return
-		}
+			log.Printf("[proxy] retrying %s status=%d attempt=%d/%d", label, candidate.status, idx+1, len(attempts))
+			return false
+		}()
 
-		if isNoRetryStatus(candidate.status, cfg.noRetryStatuses) {
-			writeResponse(c.Writer, candidate)
+		if stop {
 			return
 		}
-
-		lastResp = candidate
-		log.Printf("[proxy] retrying model=%s status=%d attempt=%d/%d", model, candidate.status, idx+1, len(attemptModels))
 	}
 
-	// Step 4: return the last upstream response if available; otherwise a 502.
+	// Step 6: return the last upstream response if available; otherwise a 502
+	// (or a 429 if the last attempt failed because its model was at its
+	// concurrency cap, matching the rate-limit rejection in step 2).
 	if lastResp != nil {
 		writeResponse(c.Writer, lastResp)
 		return
 	}
 
+	if errors.Is(lastErr, errConcurrencyExhausted) {
+		c.Header("Retry-After", "1")
+		c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "model concurrency limit exceeded"})
+		return
+	}
+
 	if lastErr != nil {
 		log.Printf("[proxy] all attempts failed: %v", lastErr)
 	}
@@ -225,14 +371,10 @@ func readRequestPayload(c *gin.Context) (map[string]interface{}, bool) {
 	return payload, true
 }
 
-func marshalPayloadWithModel(payload map[string]interface{}, model string) ([]byte, error) {
-	payload["model"] = model
-	return json.Marshal(payload)
-}
-
-// doUpstreamRequest rebuilds the request body and forwards it to the target.
+// doUpstreamRequest forwards an adapter-built request to the chosen upstream.
 // Stream requests use a header timeout to avoid cutting off long responses.
-func doUpstreamRequest(orig *http.Request, cfg *proxyConfig, body []byte, timeout time.Duration, stream bool) (*http.Response, error) {
+func doUpstreamRequest(c *gin.Context, cfg *proxyConfig, a attempt, requestURL string, body []byte, adapterHeaders http.Header, timeout time.Duration, stream bool) (*http.Response, error) {
+	orig := c.Request
 	ctx := orig.Context()
 	if !stream && timeout > 0 {
 		var cancel context.CancelFunc
@@ -240,8 +382,8 @@ func doUpstreamRequest(orig *http.Request, cfg *proxyConfig, body []byte, timeou
 		defer cancel()
 	}
 
-	upstreamURL := buildUpstreamURL(cfg.targetURL, orig)
-	req, err := http.NewRequestWithContext(ctx, orig.Method, upstreamURL.String(), bytes.NewReader(body))
+	targetURL := a.upstream.upstream.url
+	req, err := http.NewRequestWithContext(ctx, orig.Method, requestURL, bytes.NewReader(body))
 	if err != nil {
 		return nil, err
 	}
@@ -249,10 +391,31 @@ func doUpstreamRequest(orig *http.Request, cfg *proxyConfig, body []byte, timeou
 	req.Header = cloneHeader(orig.Header)
 	stripHopByHopHeaders(req.Header)
 	req.Header.Del("Accept-Encoding")
+	if cfg.authEnabled {
+		// The inbound Authorization header is the client's proxy-auth
+		// credential, not an upstream one; never forward it as-is. The
+		// adapter (via APIKey) or an upstreamKeyOverride below supplies the
+		// real upstream credential instead.
+		req.Header.Del("Authorization")
+	}
+	copyHeaders(req.Header, adapterHeaders)
 	req.ContentLength = int64(len(body))
-	req.Host = cfg.targetURL.Host
+	req.Host = targetURL.Host
 	req.Header.Set("X-Forwarded-Host", orig.Host)
-	req.Header.Set("X-Forwarded-Proto", cfg.targetURL.Scheme)
+	req.Header.Set("X-Forwarded-Proto", targetURL.Scheme)
+	if override, ok := c.Get(upstreamKeyOverride); ok {
+		key := override.(string)
+		switch a.adapter.(type) {
+		case *anthropicAdapter:
+			req.Header.Set("x-api-key", key)
+		case *geminiAdapter:
+			q := req.URL.Query()
+			q.Set("key", key)
+			req.URL.RawQuery = q.Encode()
+		default:
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+	}
 
 	if stream && timeout > 0 {
 		streamClient := newStreamClient(cfg.baseTransport, timeout)
@@ -261,12 +424,37 @@ func doUpstreamRequest(orig *http.Request, cfg *proxyConfig, body []byte, timeou
 	return cfg.client.Do(req)
 }
 
-// timeoutForAttempt chooses a timeout for primary vs fallback attempts.
-func timeoutForAttempt(cfg *proxyConfig, idx int, model string) time.Duration {
+// buildAttempts expands the fallback model list into (model, upstream, adapter)
+// tuples, selecting a healthy upstream for each model via the configured policy.
+func buildAttempts(cfg *proxyConfig, modelName string) []attempt {
+	attemptModels := buildAttemptModels(modelName, cfg.fallbackModels)
+	attempts := make([]attempt, 0, len(attemptModels))
+	for _, model := range attemptModels {
+		candidates := candidatesFor(cfg.upstreams, model, cfg.circuitCooldown)
+		selected := cfg.selectionPolicy.Select(candidates)
+		if selected == nil {
+			log.Printf("[proxy] no healthy upstream for model=%s", model)
+			continue
+		}
+		attempts = append(attempts, attempt{model: model, upstream: selected, adapter: adapterFor(selected.upstream)})
+	}
+	return attempts
+}
+
+func attemptLabel(a attempt) string {
+	return "model=" + a.model + " upstream=" + a.upstream.upstream.Name
+}
+
+// timeoutForAttempt chooses a timeout for an attempt: a per-upstream timeout
+// takes precedence, then primary vs fallback timeouts keyed by model.
+func timeoutForAttempt(cfg *proxyConfig, idx int, a attempt) time.Duration {
+	if a.upstream.upstream.timeout > 0 {
+		return a.upstream.upstream.timeout
+	}
 	if idx == 0 {
 		return cfg.defaultTimeout
 	}
-	if t, ok := cfg.fallbackTimeouts[model]; ok {
+	if t, ok := cfg.fallbackTimeouts[a.model]; ok {
 		return t
 	}
 	if cfg.fallbackDefaultTimeout > 0 {
@@ -279,6 +467,23 @@ func isSuccessStatus(status int) bool {
 	return status >= 200 && status < 300
 }
 
+func isServerErrorStatus(status int) bool {
+	return status >= 500 && status < 600
+}
+
+// recordCircuitOutcome updates the circuit breaker for a success or a 5xx
+// response. Ordinary 4xx responses (bad request, unknown model, the
+// upstream's own rate limiting, ...) are a client-traffic problem, not an
+// upstream health problem, so they neither open nor close the circuit.
+func recordCircuitOutcome(upstream *upstreamState, status int, threshold int) {
+	switch {
+	case isSuccessStatus(status):
+		upstream.recordResult(true, threshold)
+	case isServerErrorStatus(status):
+		upstream.recordResult(false, threshold)
+	}
+}
+
 func isNoRetryStatus(status int, noRetry map[int]struct{}) bool {
 	if _, ok := noRetry[status]; ok {
 		return true
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const defaultKeyLimiterCacheSize = 4096
+
+var (
+	errRateLimited          = errors.New("rate limit exceeded")
+	errConcurrencyExhausted = errors.New("model concurrency limit exceeded")
+)
+
+// rateLimiter enforces a global token bucket plus one per API key, and a
+// per-model concurrency semaphore. It sits in front of the retry loop so
+// over-limit requests never reach an upstream.
+type rateLimiter struct {
+	spec   rateSpec
+	global *rate.Limiter
+	perKey *lruLimiterCache
+
+	modelLimits map[string]int
+	modelSems   sync.Map // model -> chan struct{}
+
+	metrics *rateLimitMetrics
+}
+
+type rateSpec struct {
+	limit rate.Limit
+	burst int
+	set   bool
+}
+
+// newRateLimiter builds a limiter from RATE_LIMIT ("100/1m" style) and
+// MODEL_CONCURRENCY ("gpt-4o=10,claude=5") env values.
+func newRateLimiter(rateLimitRaw, modelConcurrencyRaw string) *rateLimiter {
+	spec := parseRateSpec(rateLimitRaw)
+	rl := &rateLimiter{
+		spec:        spec,
+		perKey:      newLRULimiterCache(defaultKeyLimiterCacheSize),
+		modelLimits: parseModelConcurrency(modelConcurrencyRaw),
+		metrics:     newRateLimitMetrics(),
+	}
+	if spec.set {
+		rl.global = rate.NewLimiter(spec.limit, spec.burst)
+	}
+	return rl
+}
+
+// allow checks the global and per-key buckets for one request and records the
+// outcome against model in the /metrics accept/reject counters. It returns
+// the duration the caller should wait before retrying when denied.
+func (rl *rateLimiter) allow(apiKey, model string) (bool, time.Duration) {
+	if !rl.spec.set {
+		rl.metrics.recordAccepted(model)
+		return true, 0
+	}
+	now := time.Now()
+
+	var global *rate.Reservation
+	if rl.global != nil {
+		r := rl.global.ReserveN(now, 1)
+		if !r.OK() {
+			rl.metrics.recordRejected(model)
+			return false, time.Second
+		}
+		if delay := r.DelayFrom(now); delay > 0 {
+			r.CancelAt(now)
+			rl.metrics.recordRejected(model)
+			return false, delay
+		}
+		global = r
+	}
+
+	if apiKey == "" {
+		rl.metrics.recordAccepted(model)
+		return true, 0
+	}
+	limiter := rl.perKey.get(apiKey, func() *rate.Limiter {
+		return rate.NewLimiter(rl.spec.limit, rl.spec.burst)
+	})
+	r := limiter.ReserveN(now, 1)
+	if !r.OK() {
+		// The per-key bucket rejected; give back the global token so a
+		// client blowing through its own limit doesn't also starve the
+		// shared bucket for every other key.
+		if global != nil {
+			global.CancelAt(now)
+		}
+		rl.metrics.recordRejected(model)
+		return false, time.Second
+	}
+	if delay := r.DelayFrom(now); delay > 0 {
+		r.CancelAt(now)
+		if global != nil {
+			global.CancelAt(now)
+		}
+		rl.metrics.recordRejected(model)
+		return false, delay
+	}
+	rl.metrics.recordAccepted(model)
+	return true, 0
+}
+
+// acquireModel waits for a concurrency slot for model, honoring ctx
+// cancellation, and is the proxy's back-pressure mechanism for
+// MODEL_CONCURRENCY: callers block until a slot frees up or ctx ends, rather
+// than failing the instant the cap is hit. Models with no configured limit
+// are never throttled. ctx ending before a slot frees is reported as
+// errConcurrencyExhausted so callers can surface a 429, not a generic failure.
+func (rl *rateLimiter) acquireModel(ctx context.Context, model string) (release func(), err error) {
+	limit, ok := rl.modelLimits[model]
+	if !ok || limit <= 0 {
+		return func() {}, nil
+	}
+
+	semVal, _ := rl.modelSems.LoadOrStore(model, make(chan struct{}, limit))
+	sem := semVal.(chan struct{})
+
+	select {
+	case sem <- struct{}{}:
+		rl.metrics.setInFlight(model, len(sem))
+		return func() {
+			<-sem
+			rl.metrics.setInFlight(model, len(sem))
+		}, nil
+	case <-ctx.Done():
+		return nil, errConcurrencyExhausted
+	}
+}
+
+// parseRateSpec parses "<count>/<window>" (e.g. "100/1m") into a rate.Limit
+// and burst size equal to count.
+func parseRateSpec(raw string) rateSpec {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return rateSpec{}
+	}
+	countStr, windowStr, ok := strings.Cut(raw, "/")
+	if !ok {
+		log.Printf("[config] invalid RATE_LIMIT=%q, rate limiting disabled", raw)
+		return rateSpec{}
+	}
+	count, err := strconv.Atoi(strings.TrimSpace(countStr))
+	if err != nil || count <= 0 {
+		log.Printf("[config] invalid RATE_LIMIT count in %q, rate limiting disabled", raw)
+		return rateSpec{}
+	}
+	window, ok := parseDurationString(windowStr)
+	if !ok || window <= 0 {
+		log.Printf("[config] invalid RATE_LIMIT window in %q, rate limiting disabled", raw)
+		return rateSpec{}
+	}
+	return rateSpec{
+		limit: rate.Limit(float64(count) / window.Seconds()),
+		burst: count,
+		set:   true,
+	}
+}
+
+// parseModelConcurrency parses "model=limit,model2=limit2" pairs.
+func parseModelConcurrency(raw string) map[string]int {
+	out := make(map[string]int)
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return out
+	}
+	for _, part := range strings.Split(raw, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		model, limitStr, ok := strings.Cut(part, "=")
+		if !ok {
+			log.Printf("[config] invalid MODEL_CONCURRENCY pair: %q", part)
+			continue
+		}
+		limit, err := strconv.Atoi(strings.TrimSpace(limitStr))
+		if err != nil || limit <= 0 {
+			log.Printf("[config] invalid MODEL_CONCURRENCY limit: %q", part)
+			continue
+		}
+		out[strings.TrimSpace(model)] = limit
+	}
+	return out
+}
+
+// lruLimiterCache bounds the number of per-key rate.Limiters kept in memory,
+// evicting the least recently used key once the cache is full. Lookups go
+// through a sync.Map for the common uncontended case; the recency list is
+// guarded by a separate mutex.
+type lruLimiterCache struct {
+	maxEntries int
+	data       sync.Map // key -> *list.Element (Element.Value is *limiterEntry)
+
+	mu    sync.Mutex
+	order *list.List
+}
+
+type limiterEntry struct {
+	key     string
+	limiter *rate.Limiter
+}
+
+func newLRULimiterCache(maxEntries int) *lruLimiterCache {
+	return &lruLimiterCache{maxEntries: maxEntries, order: list.New()}
+}
+
+func (c *lruLimiterCache) get(key string, newLimiter func() *rate.Limiter) *rate.Limiter {
+	if v, ok := c.data.Load(key); ok {
+		elem := v.(*list.Element)
+		c.mu.Lock()
+		c.order.MoveToFront(elem)
+		c.mu.Unlock()
+		return elem.Value.(*limiterEntry).limiter
+	}
+
+	entry := &limiterEntry{key: key, limiter: newLimiter()}
+	c.mu.Lock()
+	elem := c.order.PushFront(entry)
+	c.mu.Unlock()
+
+	if actual, loaded := c.data.LoadOrStore(key, elem); loaded {
+		c.mu.Lock()
+		c.order.Remove(elem)
+		c.mu.Unlock()
+		return actual.(*list.Element).Value.(*limiterEntry).limiter
+	}
+
+	c.evictIfNeeded()
+	return entry.limiter
+}
+
+func (c *lruLimiterCache) evictIfNeeded() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for c.order.Len() > c.maxEntries {
+		oldest := c.order.Back()
+		if oldest == nil {
+			return
+		}
+		c.order.Remove(oldest)
+		c.data.Delete(oldest.Value.(*limiterEntry).key)
+	}
+}
+
+// rateLimitMetrics tracks accept/reject counters and in-flight gauges per
+// model, rendered by the /metrics endpoint in Prometheus text format.
+type rateLimitMetrics struct {
+	accepted sync.Map // model -> *int64
+	rejected sync.Map // model -> *int64
+	inFlight sync.Map // model -> *int64
+}
+
+func newRateLimitMetrics() *rateLimitMetrics {
+	return &rateLimitMetrics{}
+}
+
+func (m *rateLimitMetrics) recordAccepted(model string) {
+	counter(&m.accepted, model).Add(1)
+}
+
+func (m *rateLimitMetrics) recordRejected(model string) {
+	counter(&m.rejected, model).Add(1)
+}
+
+func (m *rateLimitMetrics) setInFlight(model string, n int) {
+	counter(&m.inFlight, model).Store(int64(n))
+}
+
+func counter(m *sync.Map, model string) *atomic.Int64 {
+	v, _ := m.LoadOrStore(model, new(atomic.Int64))
+	return v.(*atomic.Int64)
+}
+
+// handleMetrics renders accept/reject counters and in-flight gauges in
+// Prometheus text exposition format.
+func handleMetrics(m *rateLimitMetrics) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		var b strings.Builder
+		b.WriteString("# HELP llm_router_requests_total Requests by model and outcome.\n")
+		b.WriteString("# TYPE llm_router_requests_total counter\n")
+		writeModelCounters(&b, "llm_router_requests_total", "accepted", &m.accepted)
+		writeModelCounters(&b, "llm_router_requests_total", "rejected", &m.rejected)
+		b.WriteString("# HELP llm_router_inflight_requests In-flight requests by model.\n")
+		b.WriteString("# TYPE llm_router_inflight_requests gauge\n")
+		writeModelGauges(&b, "llm_router_inflight_requests", &m.inFlight)
+		_, _ = w.Write([]byte(b.String()))
+	}
+}
+
+func writeModelCounters(b *strings.Builder, metric, outcome string, m *sync.Map) {
+	m.Range(func(key, value interface{}) bool {
+		fmt.Fprintf(b, "%s{model=%q,outcome=%q} %d\n", metric, key.(string), outcome, value.(*atomic.Int64).Load())
+		return true
+	})
+}
+
+func writeModelGauges(b *strings.Builder, metric string, m *sync.Map) {
+	m.Range(func(key, value interface{}) bool {
+		fmt.Fprintf(b, "%s{model=%q} %d\n", metric, key.(string), value.(*atomic.Int64).Load())
+		return true
+	})
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestParseRateSpec(t *testing.T) {
+	tests := []struct {
+		name      string
+		raw       string
+		wantSet   bool
+		wantBurst int
+	}{
+		{name: "valid count per minute", raw: "100/1m", wantSet: true, wantBurst: 100},
+		{name: "valid count per second", raw: "5/1s", wantSet: true, wantBurst: 5},
+		{name: "empty disables limiting", raw: "", wantSet: false},
+		{name: "missing slash is invalid", raw: "100", wantSet: false},
+		{name: "non-numeric count is invalid", raw: "abc/1m", wantSet: false},
+		{name: "zero count is invalid", raw: "0/1m", wantSet: false},
+		{name: "negative count is invalid", raw: "-5/1m", wantSet: false},
+		{name: "unparseable window is invalid", raw: "5/notaduration", wantSet: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec := parseRateSpec(tt.raw)
+			if spec.set != tt.wantSet {
+				t.Fatalf("parseRateSpec(%q).set = %v, want %v", tt.raw, spec.set, tt.wantSet)
+			}
+			if tt.wantSet && spec.burst != tt.wantBurst {
+				t.Errorf("parseRateSpec(%q).burst = %d, want %d", tt.raw, spec.burst, tt.wantBurst)
+			}
+		})
+	}
+}
+
+func TestRateLimiterAllowPerKeyIsolation(t *testing.T) {
+	// Build the limiter directly with no global bucket configured so this
+	// test isolates per-key bucket behavior from the shared global one.
+	rl := &rateLimiter{
+		spec:    parseRateSpec("1/1h"),
+		perKey:  newLRULimiterCache(defaultKeyLimiterCacheSize),
+		metrics: newRateLimitMetrics(),
+	}
+
+	if ok, _ := rl.allow("key-a", "gpt-4o"); !ok {
+		t.Fatalf("first request for key-a should be allowed")
+	}
+	if ok, _ := rl.allow("key-a", "gpt-4o"); ok {
+		t.Fatalf("second request for key-a should be rate limited")
+	}
+	if ok, _ := rl.allow("key-b", "gpt-4o"); !ok {
+		t.Fatalf("key-b should have its own bucket and be allowed")
+	}
+}
+
+func TestAcquireModelEnforcesLimitAndReleases(t *testing.T) {
+	rl := newRateLimiter("", "gpt-4o=1")
+	ctx := context.Background()
+
+	release, err := rl.acquireModel(ctx, "gpt-4o")
+	if err != nil {
+		t.Fatalf("first acquire: %v", err)
+	}
+
+	blockedCtx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if _, err := rl.acquireModel(blockedCtx, "gpt-4o"); !errors.Is(err, errConcurrencyExhausted) {
+		t.Fatalf("second acquire while full = %v, want errConcurrencyExhausted", err)
+	}
+
+	release()
+
+	if release2, err := rl.acquireModel(ctx, "gpt-4o"); err != nil {
+		t.Fatalf("acquire after release: %v", err)
+	} else {
+		release2()
+	}
+}
+
+func TestAcquireModelUnboundedForUnconfiguredModel(t *testing.T) {
+	rl := newRateLimiter("", "")
+	release, err := rl.acquireModel(context.Background(), "any-model")
+	if err != nil {
+		t.Fatalf("acquireModel with no MODEL_CONCURRENCY configured: %v", err)
+	}
+	release()
+}
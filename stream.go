@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	defaultStreamPreflightBytes   = 64 * 1024
+	defaultStreamPreflightTimeout = 5 * time.Second
+)
+
+// errStreamPreflightFailed indicates the upstream failed, went silent, or
+// emitted an SSE error event before any real token was observed, and the
+// attempt should be retried against the next (model, upstream) pair.
+var errStreamPreflightFailed = errors.New("stream preflight failed before first token")
+
+// preflightResult holds the transformed, ready-to-write SSE lines produced
+// while buffering the start of a stream, and whether a real token was seen.
+type preflightResult struct {
+	lines    []string // fully-formed "data: ...\n\n" (or verbatim passthrough) lines, in order
+	gotToken bool
+}
+
+// streamWithPreflight buffers the start of resp.Body until the first real
+// token (or [DONE]) is observed, an SSE error event arrives, the
+// STREAM_PREFLIGHT_BYTES cap is hit, or STREAM_PREFLIGHT_TIMEOUT elapses.
+// On success it merges header into w's header map, writes the response
+// headers, flushes the buffered prefix, and passes the remainder of the
+// stream straight through. On failure it writes nothing to w - and leaves
+// w's header map untouched - so the caller can retry the next attempt
+// without this attempt's headers or a truncated response ever reaching the
+// client.
+func streamWithPreflight(w http.ResponseWriter, resp *http.Response, header http.Header, adapter Adapter, maxBytes int, timeout time.Duration) error {
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	type scanOutcome struct {
+		result preflightResult
+		err    error
+	}
+	done := make(chan scanOutcome, 1)
+
+	go func() {
+		done <- scanOutcome{result: bufferUntilToken(scanner, adapter, maxBytes)}
+	}()
+
+	var outcome scanOutcome
+	select {
+	case outcome = <-done:
+	case <-time.After(timeout):
+		resp.Body.Close()
+		log.Printf("[proxy] stream preflight timed out after %s", timeout)
+		return errStreamPreflightFailed
+	}
+
+	if outcome.err != nil || !outcome.result.gotToken {
+		resp.Body.Close()
+		return errStreamPreflightFailed
+	}
+
+	copyHeaders(w.Header(), header)
+	w.WriteHeader(resp.StatusCode)
+	flusher, _ := w.(http.Flusher)
+	for _, line := range outcome.result.lines {
+		if _, err := w.Write([]byte(line)); err != nil {
+			return err
+		}
+	}
+	if flusher != nil {
+		flusher.Flush()
+	}
+
+	return copyRemainingSSE(w, scanner, adapter)
+}
+
+// bufferUntilToken reads SSE lines through adapter, stopping as soon as a
+// real token (or [DONE], or an "error" event) is seen, or the byte budget
+// runs out.
+func bufferUntilToken(scanner *bufio.Scanner, adapter Adapter, maxBytes int) preflightResult {
+	var out preflightResult
+	var currentEvent string
+	var budget int
+
+	for scanner.Scan() {
+		line := scanner.Text()
+		budget += len(line) + 1
+		if after, ok := strings.CutPrefix(line, "event:"); ok {
+			currentEvent = strings.TrimSpace(after)
+			out.lines = append(out.lines, line+"\n")
+			continue
+		}
+
+		data, isData := strings.CutPrefix(line, "data:")
+		if !isData {
+			out.lines = append(out.lines, line+"\n")
+			if budget >= maxBytes {
+				return out
+			}
+			continue
+		}
+
+		data = strings.TrimSpace(data)
+		if data == "[DONE]" {
+			out.lines = append(out.lines, "data: [DONE]\n")
+			out.gotToken = true
+			return out
+		}
+
+		if currentEvent == "error" {
+			return out
+		}
+
+		chunk, ok, err := adapter.TransformResponseChunk([]byte(data))
+		if err != nil {
+			continue
+		}
+		if !ok {
+			// Adapter-internal event (e.g. Anthropic's message_start) with
+			// nothing client-visible yet; keep buffering.
+			if budget >= maxBytes {
+				return out
+			}
+			continue
+		}
+
+		out.lines = append(out.lines, "data: "+string(chunk)+"\n\n")
+		if chunkHasToken(chunk) {
+			out.gotToken = true
+			return out
+		}
+		if budget >= maxBytes {
+			return out
+		}
+	}
+	return out
+}
+
+// chunkHasToken reports whether a transformed chat.completion.chunk carries
+// client-visible content: non-empty delta.content or any delta.tool_calls.
+func chunkHasToken(chunk []byte) bool {
+	var parsed struct {
+		Choices []struct {
+			Delta struct {
+				Content   string      `json:"content"`
+				ToolCalls interface{} `json:"tool_calls"`
+			} `json:"delta"`
+		} `json:"choices"`
+	}
+	if err := json.Unmarshal(chunk, &parsed); err != nil {
+		return false
+	}
+	for _, choice := range parsed.Choices {
+		if choice.Delta.Content != "" || choice.Delta.ToolCalls != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// copyRemainingSSE transforms and forwards whatever bufferUntilToken didn't
+// already consume, reusing the same scanner so no buffered bytes are lost.
+func copyRemainingSSE(w http.ResponseWriter, scanner *bufio.Scanner, adapter Adapter) error {
+	flusher, _ := w.(http.Flusher)
+	for scanner.Scan() {
+		line := scanner.Text()
+		data, isData := strings.CutPrefix(line, "data:")
+		if !isData {
+			if _, err := w.Write([]byte(line + "\n")); err != nil {
+				return err
+			}
+			continue
+		}
+
+		data = strings.TrimSpace(data)
+		if data == "[DONE]" {
+			if _, err := w.Write([]byte("data: [DONE]\n")); err != nil {
+				return err
+			}
+			continue
+		}
+
+		chunk, ok, err := adapter.TransformResponseChunk([]byte(data))
+		if err != nil {
+			log.Printf("[proxy] transform response chunk failed: %v", err)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if _, err := w.Write([]byte("data: " + string(chunk) + "\n\n")); err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// circuitState describes the passive health state of an upstream.
+type circuitState int32
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+const (
+	defaultUnhealthyThreshold  = 5
+	defaultCircuitCooldown     = 30 * time.Second
+	defaultHealthCheckPath     = "/v1/models"
+	defaultHealthCheckInterval = 0 // disabled unless configured
+	defaultHealthCheckTimeout  = 5 * time.Second
+)
+
+// upstream is one configured backend the proxy can forward requests to.
+type upstream struct {
+	Name       string   `json:"name"`
+	BaseURL    string   `json:"base_url"`
+	Weight     int      `json:"weight"`
+	Models     []string `json:"models"`
+	APIKey     string   `json:"api_key"`
+	Protocol   string   `json:"protocol"`
+	TimeoutRaw string   `json:"timeout"` // e.g. "30s"; overrides DEFAULT_TIMEOUT/FALLBACK_TIMEOUTS for this upstream
+
+	url     *url.URL
+	timeout time.Duration
+}
+
+// upstreamState wraps a configured upstream with runtime load-balancing and
+// health-tracking state. It is safe for concurrent use.
+type upstreamState struct {
+	upstream *upstream
+
+	inFlight    int64
+	consecFails int32
+	state       int32 // circuitState
+	openedAt    atomic.Value // time.Time
+
+	// smooth weighted round-robin working state, guarded by mu.
+	mu            sync.Mutex
+	currentWeight int
+}
+
+func newUpstreamState(u *upstream) *upstreamState {
+	s := &upstreamState{upstream: u}
+	s.openedAt.Store(time.Time{})
+	return s
+}
+
+func (s *upstreamState) circuit() circuitState {
+	return circuitState(atomic.LoadInt32(&s.state))
+}
+
+func (s *upstreamState) supportsModel(model string) bool {
+	if len(s.upstream.Models) == 0 {
+		return true
+	}
+	for _, m := range s.upstream.Models {
+		if m == model {
+			return true
+		}
+	}
+	return false
+}
+
+// available reports whether the upstream may currently be attempted. An open
+// circuit becomes half-open once the cooldown window elapses.
+func (s *upstreamState) available(cooldown time.Duration) bool {
+	switch s.circuit() {
+	case circuitClosed, circuitHalfOpen:
+		return true
+	case circuitOpen:
+		openedAt, _ := s.openedAt.Load().(time.Time)
+		if time.Since(openedAt) >= cooldown {
+			atomic.StoreInt32(&s.state, int32(circuitHalfOpen))
+			return true
+		}
+		return false
+	default:
+		return true
+	}
+}
+
+// recordResult updates the circuit breaker based on the outcome of an attempt.
+func (s *upstreamState) recordResult(ok bool, threshold int) {
+	if ok {
+		atomic.StoreInt32(&s.consecFails, 0)
+		atomic.StoreInt32(&s.state, int32(circuitClosed))
+		return
+	}
+	fails := atomic.AddInt32(&s.consecFails, 1)
+	if int(fails) >= threshold {
+		atomic.StoreInt32(&s.state, int32(circuitOpen))
+		s.openedAt.Store(time.Now())
+	}
+}
+
+func (s *upstreamState) acquire() {
+	atomic.AddInt64(&s.inFlight, 1)
+}
+
+func (s *upstreamState) release() {
+	atomic.AddInt64(&s.inFlight, -1)
+}
+
+// SelectionPolicy picks one upstream from a set of candidates that already
+// support the requested model and are currently healthy.
+type SelectionPolicy interface {
+	Select(candidates []*upstreamState) *upstreamState
+}
+
+type roundRobinPolicy struct {
+	counter uint64
+}
+
+func (p *roundRobinPolicy) Select(candidates []*upstreamState) *upstreamState {
+	if len(candidates) == 0 {
+		return nil
+	}
+	idx := atomic.AddUint64(&p.counter, 1) - 1
+	return candidates[int(idx)%len(candidates)]
+}
+
+type randomPolicy struct{}
+
+func (p *randomPolicy) Select(candidates []*upstreamState) *upstreamState {
+	if len(candidates) == 0 {
+		return nil
+	}
+	return candidates[rand.Intn(len(candidates))]
+}
+
+// weightedPolicy implements smooth weighted round-robin (the same algorithm
+// nginx uses for its weighted upstream selection).
+type weightedPolicy struct {
+	mu sync.Mutex
+}
+
+func (p *weightedPolicy) Select(candidates []*upstreamState) *upstreamState {
+	if len(candidates) == 0 {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	total := 0
+	var best *upstreamState
+	for _, c := range candidates {
+		weight := c.upstream.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		c.mu.Lock()
+		c.currentWeight += weight
+		if best == nil || c.currentWeight > best.currentWeight {
+			best = c
+		}
+		c.mu.Unlock()
+		total += weight
+	}
+	if best != nil {
+		best.mu.Lock()
+		best.currentWeight -= total
+		best.mu.Unlock()
+	}
+	return best
+}
+
+type leastRequestsPolicy struct{}
+
+func (p *leastRequestsPolicy) Select(candidates []*upstreamState) *upstreamState {
+	var best *upstreamState
+	var bestLoad int64 = -1
+	for _, c := range candidates {
+		load := atomic.LoadInt64(&c.inFlight)
+		if bestLoad == -1 || load < bestLoad {
+			best = c
+			bestLoad = load
+		}
+	}
+	return best
+}
+
+type firstAvailablePolicy struct{}
+
+func (p *firstAvailablePolicy) Select(candidates []*upstreamState) *upstreamState {
+	if len(candidates) == 0 {
+		return nil
+	}
+	return candidates[0]
+}
+
+func newSelectionPolicy(name string) SelectionPolicy {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "random":
+		return &randomPolicy{}
+	case "weighted":
+		return &weightedPolicy{}
+	case "least-requests", "least_requests":
+		return &leastRequestsPolicy{}
+	case "first-available", "first_available":
+		return &firstAvailablePolicy{}
+	case "round-robin", "round_robin", "":
+		return &roundRobinPolicy{}
+	default:
+		log.Printf("[config] unknown SELECTION_POLICY=%q, using round-robin", name)
+		return &roundRobinPolicy{}
+	}
+}
+
+// parseUpstreams loads the upstream pool from the UPSTREAMS env var. The
+// value is either inline JSON (a list of upstream objects) or a path to a
+// JSON file containing the same shape.
+func parseUpstreams(raw string, fallbackBase *url.URL) []*upstream {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return []*upstream{{Name: "default", BaseURL: fallbackBase.String(), Weight: 1, Protocol: "openai", url: fallbackBase}}
+	}
+
+	var data []byte
+	if strings.HasPrefix(raw, "[") || strings.HasPrefix(raw, "{") {
+		data = []byte(raw)
+	} else {
+		content, err := os.ReadFile(raw)
+		if err != nil {
+			log.Printf("[config] failed to read UPSTREAMS file %q: %v, falling back to single upstream", raw, err)
+			return []*upstream{{Name: "default", BaseURL: fallbackBase.String(), Weight: 1, Protocol: "openai", url: fallbackBase}}
+		}
+		data = content
+	}
+
+	var parsed []*upstream
+	if err := json.Unmarshal(data, &parsed); err != nil {
+		log.Printf("[config] invalid UPSTREAMS JSON: %v, falling back to single upstream", err)
+		return []*upstream{{Name: "default", BaseURL: fallbackBase.String(), Weight: 1, Protocol: "openai", url: fallbackBase}}
+	}
+
+	out := make([]*upstream, 0, len(parsed))
+	for _, u := range parsed {
+		parsedURL, err := url.Parse(u.BaseURL)
+		if err != nil {
+			log.Printf("[config] upstream %q has invalid base_url %q: %v, skipping", u.Name, u.BaseURL, err)
+			continue
+		}
+		if u.Weight <= 0 {
+			u.Weight = 1
+		}
+		if u.Protocol == "" {
+			u.Protocol = "openai"
+		}
+		if u.TimeoutRaw != "" {
+			if d, ok := parseDurationString(u.TimeoutRaw); ok {
+				u.timeout = d
+			} else {
+				log.Printf("[config] upstream %q has invalid timeout %q, ignoring", u.Name, u.TimeoutRaw)
+			}
+		}
+		u.url = parsedURL
+		out = append(out, u)
+	}
+	if len(out) == 0 {
+		return []*upstream{{Name: "default", BaseURL: fallbackBase.String(), Weight: 1, Protocol: "openai", url: fallbackBase}}
+	}
+	return out
+}
+
+func parseIntEnv(key string, fallback int) int {
+	raw := strings.TrimSpace(os.Getenv(key))
+	if raw == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil {
+		log.Printf("[config] invalid %s=%q, using fallback %d", key, raw, fallback)
+		return fallback
+	}
+	return n
+}
+
+// candidatesFor returns the healthy upstream states eligible for model.
+func candidatesFor(states []*upstreamState, model string, cooldown time.Duration) []*upstreamState {
+	out := make([]*upstreamState, 0, len(states))
+	for _, s := range states {
+		if s.supportsModel(model) && s.available(cooldown) {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// startHealthChecker periodically probes every non-healthy upstream with a
+// cheap GET and closes the circuit for any that respond successfully. It
+// runs until the process exits.
+func startHealthChecker(states []*upstreamState, client *http.Client, interval, timeout time.Duration, path string) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	go func() {
+		for range ticker.C {
+			for _, s := range states {
+				if s.circuit() == circuitClosed {
+					continue
+				}
+				probeUpstream(client, s, timeout, path)
+			}
+		}
+	}()
+}
+
+// probeUpstream issues one bounded health-check GET against s. Each probe
+// gets its own timeout so a single upstream that accepts the connection but
+// never responds can't stall health checks for every other upstream in the
+// sequential loop above for the life of the process.
+func probeUpstream(client *http.Client, s *upstreamState, timeout time.Duration, path string) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.upstream.url.String()+path, nil)
+	if err != nil {
+		log.Printf("[health] probe request failed upstream=%s: %v", s.upstream.Name, err)
+		return
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Printf("[health] probe failed upstream=%s: %v", s.upstream.Name, err)
+		return
+	}
+	defer resp.Body.Close()
+	if isSuccessStatus(resp.StatusCode) {
+		s.recordResult(true, 0)
+	}
+}
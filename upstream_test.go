@@ -0,0 +1,54 @@
+package main
+
+import "testing"
+
+func TestWeightedPolicySelectDistributesByWeight(t *testing.T) {
+	heavy := &upstreamState{upstream: &upstream{Name: "heavy", Weight: 3}}
+	light := &upstreamState{upstream: &upstream{Name: "light", Weight: 1}}
+	candidates := []*upstreamState{heavy, light}
+
+	policy := &weightedPolicy{}
+	counts := map[string]int{}
+	const rounds = 40
+	for i := 0; i < rounds; i++ {
+		selected := policy.Select(candidates)
+		if selected == nil {
+			t.Fatalf("Select returned nil on round %d", i)
+		}
+		counts[selected.upstream.Name]++
+	}
+
+	if counts["heavy"] <= counts["light"] {
+		t.Errorf("heavy (weight 3) selected %d times, light (weight 1) selected %d times; want heavy > light", counts["heavy"], counts["light"])
+	}
+	if counts["heavy"]+counts["light"] != rounds {
+		t.Fatalf("counts sum to %d, want %d", counts["heavy"]+counts["light"], rounds)
+	}
+}
+
+func TestWeightedPolicySelectNoCandidates(t *testing.T) {
+	policy := &weightedPolicy{}
+	if got := policy.Select(nil); got != nil {
+		t.Errorf("Select(nil) = %v, want nil", got)
+	}
+}
+
+func TestWeightedPolicySelectSmoothsAcrossRounds(t *testing.T) {
+	// Equal weights should alternate rather than repeatedly pick the same
+	// upstream: smooth weighted round-robin decrements the chosen candidate's
+	// currentWeight by the total, so it can't win twice in a row once a peer
+	// is caught up.
+	a := &upstreamState{upstream: &upstream{Name: "a", Weight: 1}}
+	b := &upstreamState{upstream: &upstream{Name: "b", Weight: 1}}
+	candidates := []*upstreamState{a, b}
+	policy := &weightedPolicy{}
+
+	var lastName string
+	for i := 0; i < 10; i++ {
+		selected := policy.Select(candidates)
+		if i > 0 && selected.upstream.Name == lastName {
+			t.Fatalf("round %d: selected %q twice in a row with equal weights", i, lastName)
+		}
+		lastName = selected.upstream.Name
+	}
+}
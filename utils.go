@@ -1,11 +1,9 @@
 package main
 
 import (
-	"errors"
 	"io"
 	"log"
 	"net/http"
-	"net/url"
 	"os"
 	"strconv"
 	"strings"
@@ -50,28 +48,6 @@ func writeResponse(w http.ResponseWriter, resp *cachedResponse) {
 	}
 }
 
-func copyStream(dst http.ResponseWriter, src io.Reader) error {
-	buf := make([]byte, 32*1024)
-	flusher, _ := dst.(http.Flusher)
-	for {
-		n, err := src.Read(buf)
-		if n > 0 {
-			if _, werr := dst.Write(buf[:n]); werr != nil {
-				return werr
-			}
-			if flusher != nil {
-				flusher.Flush()
-			}
-		}
-		if err != nil {
-			if errors.Is(err, io.EOF) {
-				return nil
-			}
-			return err
-		}
-	}
-}
-
 func copyHeaders(dst, src http.Header) {
 	for k, v := range src {
 		dst[k] = append([]string(nil), v...)
@@ -97,13 +73,6 @@ func newStreamClient(base *http.Transport, timeout time.Duration) *http.Client {
 	return &http.Client{Transport: transport}
 }
 
-func buildUpstreamURL(base *url.URL, orig *http.Request) *url.URL {
-	target := *base
-	target.Path = singleJoiningSlash(base.Path, orig.URL.Path)
-	target.RawQuery = joinQuery(base.RawQuery, orig.URL.RawQuery)
-	return &target
-}
-
 func singleJoiningSlash(a, b string) string {
 	aslash := strings.HasSuffix(a, "/")
 	bslash := strings.HasPrefix(b, "/")
@@ -117,16 +86,6 @@ func singleJoiningSlash(a, b string) string {
 	}
 }
 
-func joinQuery(a, b string) string {
-	if a == "" {
-		return b
-	}
-	if b == "" {
-		return a
-	}
-	return a + "&" + b
-}
-
 func isStreamRequest(payload map[string]interface{}) bool {
 	raw, ok := payload["stream"]
 	if !ok {